@@ -0,0 +1,151 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package mounter provides a small abstraction over the mount(8) and
+// umount(8) commands. configcore handlers that manage mount points use
+// this interface instead of shelling out directly, so that tests can
+// substitute a FakeMounter rather than mocking binaries on PATH.
+package mounter
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/snapcore/snapd/osutil"
+)
+
+// MountInfo describes one entry of the system's mount table, as read
+// from /proc/self/mountinfo.
+type MountInfo struct {
+	MountPoint string
+	FSType     string
+	Source     string
+	Options    []string
+}
+
+// Mounter is the interface configcore uses to manage mount points.
+type Mounter interface {
+	// Mount mounts source on target with the given filesystem type and
+	// options, as in "mount -t fstype -o opts... source target". source
+	// and fstype may be empty, e.g. for a plain "-o remount" call.
+	Mount(source, target, fstype string, opts []string) error
+	// Unmount unmounts target. flags are as accepted by umount(2); only
+	// unix.MNT_FORCE and unix.MNT_DETACH are honoured.
+	Unmount(target string, flags int) error
+	// IsMountPoint reports whether target is currently mounted.
+	IsMountPoint(target string) (bool, error)
+	// List returns the mount points currently known to the system.
+	List() ([]MountInfo, error)
+}
+
+// New returns the default, production Mounter, backed by the
+// mount(8)/umount(8) commands.
+func New() Mounter {
+	return &execMounter{}
+}
+
+type execMounter struct{}
+
+func (m *execMounter) Mount(source, target, fstype string, opts []string) error {
+	args := make([]string, 0, len(opts)+4)
+	if fstype != "" {
+		args = append(args, "-t", fstype)
+	}
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	if source != "" {
+		args = append(args, source)
+	}
+	args = append(args, target)
+
+	cmd := exec.Command("mount", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(out, err)
+	}
+	return nil
+}
+
+func (m *execMounter) Unmount(target string, flags int) error {
+	args := make([]string, 0, 3)
+	if flags&unix.MNT_DETACH != 0 {
+		args = append(args, "-l")
+	}
+	if flags&unix.MNT_FORCE != 0 {
+		args = append(args, "-f")
+	}
+	args = append(args, target)
+
+	cmd := exec.Command("umount", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return osutil.OutputErr(out, err)
+	}
+	return nil
+}
+
+func (m *execMounter) IsMountPoint(target string) (bool, error) {
+	mounts, err := m.List()
+	if err != nil {
+		return false, err
+	}
+	for _, mnt := range mounts {
+		if mnt.MountPoint == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *execMounter) List() ([]MountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// mountinfo entries have a fixed part and a variable part
+		// separated by a literal " - ", see proc(5).
+		fields := strings.SplitN(scanner.Text(), " - ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		pre := strings.Fields(fields[0])
+		post := strings.Fields(fields[1])
+		if len(pre) < 5 || len(post) < 3 {
+			continue
+		}
+		mounts = append(mounts, MountInfo{
+			MountPoint: pre[4],
+			FSType:     post[0],
+			Source:     post[1],
+			Options:    strings.Split(post[2], ","),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
@@ -0,0 +1,117 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package mounter
+
+import "fmt"
+
+// FakeAction records a single operation performed on a FakeMounter.
+type FakeAction struct {
+	Action  string // "mount" or "unmount"
+	Source  string
+	Target  string
+	FSType  string
+	Options []string
+}
+
+func (a FakeAction) String() string {
+	switch a.Action {
+	case "mount":
+		return fmt.Sprintf("mount %q on %q (fstype:%q opts:%v)", a.Source, a.Target, a.FSType, a.Options)
+	case "unmount":
+		return fmt.Sprintf("unmount %q", a.Target)
+	default:
+		return fmt.Sprintf("unknown mounter action %q", a.Action)
+	}
+}
+
+// FakeMounter is a Mounter for use in tests. It records every
+// Mount/Unmount call as a FakeAction and can be pre-seeded with the
+// mount points it should report via IsMountPoint/List.
+type FakeMounter struct {
+	Actions []FakeAction
+	Mounts  []MountInfo
+
+	// FailMountAfter, if positive, makes the FailMountAfter-th Mount
+	// call succeed and every later Mount call fail. 0 means never fail.
+	// Useful for exercising partial-failure handling across several
+	// mount points.
+	FailMountAfter int
+
+	mountCalls int
+}
+
+// NewFake returns a FakeMounter pre-seeded with the given mount points.
+func NewFake(seed ...MountInfo) *FakeMounter {
+	return &FakeMounter{Mounts: append([]MountInfo{}, seed...)}
+}
+
+func (f *FakeMounter) Mount(source, target, fstype string, opts []string) error {
+	f.mountCalls++
+	f.Actions = append(f.Actions, FakeAction{
+		Action:  "mount",
+		Source:  source,
+		Target:  target,
+		FSType:  fstype,
+		Options: opts,
+	})
+	if f.FailMountAfter > 0 && f.mountCalls > f.FailMountAfter {
+		return fmt.Errorf("fake mount failure on call %d (source:%q target:%q)", f.mountCalls, source, target)
+	}
+	for i, mnt := range f.Mounts {
+		if mnt.MountPoint == target {
+			// An empty fstype/source (as used by a plain "-o remount"
+			// call) means "unchanged", matching real mount(8) semantics.
+			if fstype == "" {
+				fstype = mnt.FSType
+			}
+			if source == "" {
+				source = mnt.Source
+			}
+			f.Mounts[i] = MountInfo{MountPoint: target, FSType: fstype, Source: source, Options: opts}
+			return nil
+		}
+	}
+	f.Mounts = append(f.Mounts, MountInfo{MountPoint: target, FSType: fstype, Source: source, Options: opts})
+	return nil
+}
+
+func (f *FakeMounter) Unmount(target string, flags int) error {
+	f.Actions = append(f.Actions, FakeAction{Action: "unmount", Target: target})
+	for i, mnt := range f.Mounts {
+		if mnt.MountPoint == target {
+			f.Mounts = append(f.Mounts[:i], f.Mounts[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *FakeMounter) IsMountPoint(target string) (bool, error) {
+	for _, mnt := range f.Mounts {
+		if mnt.MountPoint == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *FakeMounter) List() ([]MountInfo, error) {
+	return append([]MountInfo{}, f.Mounts...), nil
+}
@@ -0,0 +1,156 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package mounter_test
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+	"gopkg.in/check.v1"
+
+	"github.com/snapcore/snapd/overlord/configstate/configcore/mounter"
+	"github.com/snapcore/snapd/testutil"
+)
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type mounterSuite struct{}
+
+var _ = check.Suite(&mounterSuite{})
+
+func (s *mounterSuite) TestExecMounterMount(c *check.C) {
+	cmd := testutil.MockCommand(c, "mount", "")
+	defer cmd.Restore()
+
+	m := mounter.New()
+	err := m.Mount("/dev/sda1", "/mnt", "ext4", []string{"ro", "noatime"})
+	c.Assert(err, check.IsNil)
+
+	c.Check(cmd.Calls(), check.DeepEquals, [][]string{
+		{"mount", "-t", "ext4", "-o", "ro,noatime", "/dev/sda1", "/mnt"},
+	})
+}
+
+func (s *mounterSuite) TestExecMounterMountRemountNoSource(c *check.C) {
+	cmd := testutil.MockCommand(c, "mount", "")
+	defer cmd.Restore()
+
+	m := mounter.New()
+	err := m.Mount("", "/tmp", "", []string{"remount", "size=100m"})
+	c.Assert(err, check.IsNil)
+
+	c.Check(cmd.Calls(), check.DeepEquals, [][]string{
+		{"mount", "-o", "remount,size=100m", "/tmp"},
+	})
+}
+
+func (s *mounterSuite) TestExecMounterMountError(c *check.C) {
+	cmd := testutil.MockCommand(c, "mount", "echo cannot mount; exit 1")
+	defer cmd.Restore()
+
+	m := mounter.New()
+	err := m.Mount("", "/tmp", "", []string{"remount"})
+	c.Assert(err, check.ErrorMatches, "(?s).*cannot mount.*")
+}
+
+func (s *mounterSuite) TestExecMounterUnmountPlain(c *check.C) {
+	cmd := testutil.MockCommand(c, "umount", "")
+	defer cmd.Restore()
+
+	m := mounter.New()
+	err := m.Unmount("/mnt", 0)
+	c.Assert(err, check.IsNil)
+
+	c.Check(cmd.Calls(), check.DeepEquals, [][]string{{"umount", "/mnt"}})
+}
+
+func (s *mounterSuite) TestExecMounterUnmountFlags(c *check.C) {
+	cmd := testutil.MockCommand(c, "umount", "")
+	defer cmd.Restore()
+
+	m := mounter.New()
+	err := m.Unmount("/mnt", unix.MNT_DETACH|unix.MNT_FORCE)
+	c.Assert(err, check.IsNil)
+
+	c.Check(cmd.Calls(), check.DeepEquals, [][]string{{"umount", "-l", "-f", "/mnt"}})
+}
+
+func (s *mounterSuite) TestFakeMounterRecordsActions(c *check.C) {
+	fake := mounter.NewFake()
+
+	c.Assert(fake.Mount("src", "/mnt", "ext4", []string{"ro"}), check.IsNil)
+	isMp, err := fake.IsMountPoint("/mnt")
+	c.Assert(err, check.IsNil)
+	c.Check(isMp, check.Equals, true)
+
+	c.Assert(fake.Unmount("/mnt", 0), check.IsNil)
+	isMp, err = fake.IsMountPoint("/mnt")
+	c.Assert(err, check.IsNil)
+	c.Check(isMp, check.Equals, false)
+
+	c.Check(fake.Actions, check.DeepEquals, []mounter.FakeAction{
+		{Action: "mount", Source: "src", Target: "/mnt", FSType: "ext4", Options: []string{"ro"}},
+		{Action: "unmount", Target: "/mnt"},
+	})
+}
+
+func (s *mounterSuite) TestFakeMounterSeededMounts(c *check.C) {
+	fake := mounter.NewFake(mounter.MountInfo{MountPoint: "/tmp", FSType: "tmpfs", Options: []string{"size=50%"}})
+
+	mounts, err := fake.List()
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, []mounter.MountInfo{
+		{MountPoint: "/tmp", FSType: "tmpfs", Options: []string{"size=50%"}},
+	})
+
+	isMp, err := fake.IsMountPoint("/tmp")
+	c.Assert(err, check.IsNil)
+	c.Check(isMp, check.Equals, true)
+
+	// remounting an already-seeded mount point updates it in place, but
+	// leaves FSType/Source alone since the remount call passes them empty
+	c.Assert(fake.Mount("", "/tmp", "", []string{"remount", "size=100m"}), check.IsNil)
+	mounts, err = fake.List()
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, []mounter.MountInfo{
+		{MountPoint: "/tmp", FSType: "tmpfs", Options: []string{"remount", "size=100m"}},
+	})
+}
+
+func (s *mounterSuite) TestFakeMounterSeededMountsRemountCanChangeFields(c *check.C) {
+	fake := mounter.NewFake(mounter.MountInfo{MountPoint: "/tmp", FSType: "tmpfs", Source: "tmpfs"})
+
+	// a non-empty fstype/source on a later call still takes effect
+	c.Assert(fake.Mount("swap", "/tmp", "swapfs", []string{"ro"}), check.IsNil)
+	mounts, err := fake.List()
+	c.Assert(err, check.IsNil)
+	c.Check(mounts, check.DeepEquals, []mounter.MountInfo{
+		{MountPoint: "/tmp", FSType: "swapfs", Source: "swap", Options: []string{"ro"}},
+	})
+}
+
+func (s *mounterSuite) TestFakeMounterFailOnCall(c *check.C) {
+	fake := mounter.NewFake()
+	fake.FailMountAfter = 1
+
+	c.Assert(fake.Mount("", "/tmp", "", []string{"remount", "size=100m"}), check.IsNil)
+	err := fake.Mount("", "/dev/shm", "", []string{"remount", "size=200m"})
+	c.Assert(err, check.ErrorMatches, "fake mount failure.*")
+}
@@ -0,0 +1,495 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// This file manages the tmpfs mounts snapd knows how to tune: /tmp,
+// /dev/shm, /run and /run/lock. /tmp additionally exposes the full
+// tmpfs option set (mode, noexec, huge, nr-inodes, nosuid/nodev/
+// strictatime overrides) via tmp.* keys; the other mount points only
+// expose their size via a <prefix>.size key, using the same validation
+// as tmp.size.
+package configcore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/dirs"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/overlord/configstate/configcore/mounter"
+)
+
+func init() {
+	// add supported configuration of this module
+	supportedConfigurations["core.tmp.size"] = true
+	supportedConfigurations["core.tmp.mode"] = true
+	supportedConfigurations["core.tmp.noexec"] = true
+	supportedConfigurations["core.tmp.nr-inodes"] = true
+	supportedConfigurations["core.tmp.huge"] = true
+	supportedConfigurations["core.tmp.nosuid"] = true
+	supportedConfigurations["core.tmp.nodev"] = true
+	supportedConfigurations["core.tmp.strictatime"] = true
+	supportedConfigurations["core.tmp.uid"] = true
+	supportedConfigurations["core.tmp.gid"] = true
+	supportedConfigurations["core.shm.size"] = true
+	supportedConfigurations["core.run.size"] = true
+	supportedConfigurations["core.run-lock.size"] = true
+	addFSOnlyHandler(validateTmpfsSettings, handleTmpfsCfg)
+}
+
+const (
+	tmpfsDefaultMode = "1777"
+	tmpfsDefaultSize = "50%"
+	tmpfsMinSize     = 16 * 1024 * 1024
+)
+
+var tmpfsHugeValues = map[string]bool{
+	"never":       true,
+	"always":      true,
+	"within_size": true,
+	"advise":      true,
+	"deny":        true,
+	"force":       true,
+}
+
+var (
+	tmpfsSizeRegexp  = regexp.MustCompile(`^[0-9]+([kKmMgG]|%)?$`)
+	tmpfsCountRegexp = regexp.MustCompile(`^[0-9]+[kKmM]?$`)
+)
+
+// tmpfsMounter is the Mounter used to apply tmpfs remounts. Production
+// code uses the real mount(8)/umount(8) backed implementation; tests
+// replace it with a mounter.FakeMounter via MockMounter.
+var tmpfsMounter mounter.Mounter = mounter.New()
+
+// MockMounter replaces the Mounter used by the tmpfs handlers, for use
+// in tests.
+func MockMounter(m mounter.Mounter) (restore func()) {
+	osutil.MustBeTestBinary("MockMounter can only be used in tests")
+	old := tmpfsMounter
+	tmpfsMounter = m
+	return func() {
+		tmpfsMounter = old
+	}
+}
+
+func tmpfsSizeToBytes(size string) (int64, error) {
+	if size == "0" {
+		return 0, nil
+	}
+	numPart := size
+	multiplier := int64(1)
+	switch size[len(size)-1] {
+	case 'k', 'K':
+		multiplier = 1024
+		numPart = size[:len(size)-1]
+	case 'm', 'M':
+		multiplier = 1024 * 1024
+		numPart = size[:len(size)-1]
+	case 'g', 'G':
+		multiplier = 1024 * 1024 * 1024
+		numPart = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(numPart, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid suffix in size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+func validateTmpfsSize(label, size string, minSize int64) error {
+	if size == "" {
+		return nil
+	}
+	if !tmpfsSizeRegexp.MatchString(size) {
+		return fmt.Errorf("cannot set %s size: invalid suffix in size %q", label, size)
+	}
+	if strings.HasSuffix(size, "%") {
+		return nil
+	}
+	bytes, err := tmpfsSizeToBytes(size)
+	if err != nil {
+		return fmt.Errorf("cannot set %s size: %v", label, err)
+	}
+	if bytes != 0 && bytes < minSize {
+		return fmt.Errorf("size is less than 16Mb")
+	}
+	return nil
+}
+
+func validateTmpfsMode(mode string) (uint64, error) {
+	v, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("cannot set tmpfs mode: invalid octal mode %q", mode)
+	}
+	if v > 01777 {
+		return 0, fmt.Errorf("cannot set tmpfs mode: mode %q is out of range (0000-1777)", mode)
+	}
+	return v, nil
+}
+
+func validateTmpfsNrInodes(count string) error {
+	if !tmpfsCountRegexp.MatchString(count) {
+		return fmt.Errorf("cannot set tmpfs nr-inodes: invalid value %q", count)
+	}
+	return nil
+}
+
+func validateTmpfsHuge(huge string) error {
+	if !tmpfsHugeValues[huge] {
+		return fmt.Errorf("cannot set tmpfs huge: invalid value %q", huge)
+	}
+	return nil
+}
+
+func validateTmpfsBool(key, val string) error {
+	if _, err := strconv.ParseBool(val); err != nil {
+		return fmt.Errorf("cannot set tmpfs %s: %q is not a bool", key, val)
+	}
+	return nil
+}
+
+func validateTmpfsID(key, val string) error {
+	if _, err := strconv.ParseUint(val, 10, 32); err != nil {
+		return fmt.Errorf("cannot set tmpfs %s: invalid value %q", key, val)
+	}
+	return nil
+}
+
+// tmpfsMount describes one tmpfs mount point configcore knows how to
+// tune. Each mount reuses the same code path for override-file writing,
+// idempotency comparison and remounting; only composeOptions differs
+// between them.
+type tmpfsMount struct {
+	// configPrefix is the config key prefix, e.g. "tmp" for "tmp.size".
+	configPrefix string
+	// sizeLabel names this mount in size-related error messages, e.g.
+	// "tmpfs" for tmp.size (kept as-is for backwards compatible error
+	// messages).
+	sizeLabel string
+	// unitName is the systemd mount unit this mount point is backed by,
+	// e.g. "tmp.mount".
+	unitName string
+	// mountPoint is the path passed to "mount -o remount".
+	mountPoint string
+	// minSize is the smallest non-zero, non-percentage size accepted.
+	minSize int64
+	// composeOptions returns the canonical, deterministic Options=
+	// fields for this mount (excluding size) and whether any of its
+	// non-size config keys are set away from their default.
+	composeOptions func(tr Conf) (fields []string, customized bool, err error)
+}
+
+// tmpfsStaticOptions returns a composeOptions func for mounts that only
+// support a fixed set of default options plus their size.
+func tmpfsStaticOptions(options string) func(Conf) ([]string, bool, error) {
+	fields := strings.Split(options, ",")
+	return func(tr Conf) ([]string, bool, error) {
+		return append([]string{}, fields...), false, nil
+	}
+}
+
+func tmpExtraOptions(tr Conf) (fields []string, customized bool, err error) {
+	mode, err := coreCfg(tr, "tmp.mode")
+	if err != nil {
+		return nil, false, err
+	}
+	if mode != "" {
+		customized = true
+	} else {
+		mode = tmpfsDefaultMode
+	}
+	v, err := validateTmpfsMode(mode)
+	if err != nil {
+		return nil, false, err
+	}
+	fields = append(fields, fmt.Sprintf("mode=%o", v))
+
+	for _, bf := range []struct {
+		key string
+		def bool
+	}{
+		{"tmp.strictatime", true},
+		{"tmp.nosuid", true},
+		{"tmp.nodev", true},
+		{"tmp.noexec", false},
+	} {
+		raw, err := coreCfg(tr, bf.key)
+		if err != nil {
+			return nil, false, err
+		}
+		val := bf.def
+		if raw != "" {
+			customized = true
+			// already validated by validateTmpfsSettings
+			val, _ = strconv.ParseBool(raw)
+		}
+		if val {
+			fields = append(fields, strings.TrimPrefix(bf.key, "tmp."))
+		}
+	}
+
+	nrInodes, err := coreCfg(tr, "tmp.nr-inodes")
+	if err != nil {
+		return nil, false, err
+	}
+	if nrInodes != "" {
+		customized = true
+		if err := validateTmpfsNrInodes(nrInodes); err != nil {
+			return nil, false, err
+		}
+		fields = append(fields, "nr_inodes="+nrInodes)
+	}
+
+	huge, err := coreCfg(tr, "tmp.huge")
+	if err != nil {
+		return nil, false, err
+	}
+	if huge != "" {
+		customized = true
+		if err := validateTmpfsHuge(huge); err != nil {
+			return nil, false, err
+		}
+		fields = append(fields, "huge="+huge)
+	}
+
+	for _, idKey := range []string{"tmp.uid", "tmp.gid"} {
+		id, err := coreCfg(tr, idKey)
+		if err != nil {
+			return nil, false, err
+		}
+		if id != "" {
+			customized = true
+			if err := validateTmpfsID(strings.TrimPrefix(idKey, "tmp."), id); err != nil {
+				return nil, false, err
+			}
+			fields = append(fields, strings.TrimPrefix(idKey, "tmp.")+"="+id)
+		}
+	}
+
+	return fields, customized, nil
+}
+
+var tmpfsMounts = []tmpfsMount{
+	{
+		configPrefix:   "tmp",
+		sizeLabel:      "tmpfs",
+		unitName:       "tmp.mount",
+		mountPoint:     "/tmp",
+		minSize:        tmpfsMinSize,
+		composeOptions: tmpExtraOptions,
+	},
+	{
+		configPrefix:   "shm",
+		sizeLabel:      "shm",
+		unitName:       "dev-shm.mount",
+		mountPoint:     "/dev/shm",
+		minSize:        tmpfsMinSize,
+		composeOptions: tmpfsStaticOptions("mode=1777,strictatime,nosuid,nodev"),
+	},
+	{
+		configPrefix:   "run",
+		sizeLabel:      "run",
+		unitName:       "run.mount",
+		mountPoint:     "/run",
+		minSize:        tmpfsMinSize,
+		composeOptions: tmpfsStaticOptions("mode=0755,strictatime,nosuid,nodev"),
+	},
+	{
+		configPrefix:   "run-lock",
+		sizeLabel:      "run-lock",
+		unitName:       "run-lock.mount",
+		mountPoint:     "/run/lock",
+		minSize:        tmpfsMinSize,
+		composeOptions: tmpfsStaticOptions("mode=1777,strictatime,nosuid,nodev"),
+	},
+}
+
+func (m tmpfsMount) sizeKey() string {
+	return m.configPrefix + ".size"
+}
+
+// options composes the canonical, deterministic Options= value for m
+// from the current configuration, and reports whether any of m's
+// config keys are set away from their defaults.
+func (m tmpfsMount) options(tr Conf) (opts string, customized bool, err error) {
+	fields, customized, err := m.composeOptions(tr)
+	if err != nil {
+		return "", false, err
+	}
+
+	size, err := coreCfg(tr, m.sizeKey())
+	if err != nil {
+		return "", false, err
+	}
+	if size != "" {
+		customized = true
+	} else {
+		size = tmpfsDefaultSize
+	}
+	if err := validateTmpfsSize(m.sizeLabel, size, m.minSize); err != nil {
+		return "", false, err
+	}
+	fields = append(fields, "size="+size)
+
+	return strings.Join(fields, ","), customized, nil
+}
+
+func (m tmpfsMount) overridePath(rootDir string) string {
+	return filepath.Join(dirs.SnapServicesDirUnder(rootDir), m.unitName+".d", "override.conf")
+}
+
+func validateTmpfsSettings(tr Conf) error {
+	for _, opt := range []struct {
+		key      string
+		validate func(string) error
+	}{
+		{"tmp.mode", func(v string) error { _, err := validateTmpfsMode(v); return err }},
+		{"tmp.noexec", func(v string) error { return validateTmpfsBool("noexec", v) }},
+		{"tmp.nr-inodes", validateTmpfsNrInodes},
+		{"tmp.huge", validateTmpfsHuge},
+		{"tmp.nosuid", func(v string) error { return validateTmpfsBool("nosuid", v) }},
+		{"tmp.nodev", func(v string) error { return validateTmpfsBool("nodev", v) }},
+		{"tmp.strictatime", func(v string) error { return validateTmpfsBool("strictatime", v) }},
+		{"tmp.uid", func(v string) error { return validateTmpfsID("uid", v) }},
+		{"tmp.gid", func(v string) error { return validateTmpfsID("gid", v) }},
+	} {
+		val, err := coreCfg(tr, opt.key)
+		if err != nil {
+			return err
+		}
+		if val == "" {
+			continue
+		}
+		if err := opt.validate(val); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range tmpfsMounts {
+		size, err := coreCfg(tr, m.sizeKey())
+		if err != nil {
+			return err
+		}
+		if err := validateTmpfsSize(m.sizeLabel, size, m.minSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleTmpfsCfg writes (or removes) the override.conf for each tmpfs
+// mount in tmpfsMounts and, on a live system, remounts it so the change
+// takes effect immediately.
+//
+// Each mount point is written and (on a live system) remounted before
+// moving on to the next one, so that if a later mount point fails to
+// remount, only its own, not-yet-live override.conf change is reverted:
+// earlier mount points whose remount already succeeded are left alone,
+// since their override.conf already matches what is actually live.
+func handleTmpfsCfg(tr Conf, opts *fsOnlyContext) error {
+	rootDir := dirs.GlobalRootDir
+	live := opts == nil
+	if opts != nil {
+		rootDir = opts.RootDir
+	}
+
+	type revert struct {
+		path    string
+		existed bool
+		content []byte
+	}
+	// pending holds the revert for the override.conf just written (if
+	// any) for the mount point currently being applied. It is cleared
+	// as soon as that mount point's remount is confirmed, so a later
+	// failure can never unwind a change that is already live.
+	var pending []revert
+	revertPending := func() {
+		for i := len(pending) - 1; i >= 0; i-- {
+			r := pending[i]
+			if r.existed {
+				osutil.AtomicWriteFile(r.path, r.content, 0644, 0)
+			} else {
+				os.Remove(r.path)
+			}
+		}
+		pending = nil
+	}
+
+	for _, m := range tmpfsMounts {
+		mountOpts, customized, err := m.options(tr)
+		if err != nil {
+			revertPending()
+			return err
+		}
+
+		overridePath := m.overridePath(rootDir)
+		overrideDir := filepath.Dir(overridePath)
+
+		old, readErr := ioutil.ReadFile(overridePath)
+		existed := readErr == nil
+
+		remount := false
+		switch {
+		case !customized && !existed:
+			// already at defaults, nothing on disk either
+		case !customized:
+			if err := os.Remove(overridePath); err != nil {
+				revertPending()
+				return err
+			}
+			pending = append(pending, revert{overridePath, true, old})
+			remount = live
+		default:
+			content := []byte(fmt.Sprintf("[Mount]\nOptions=%s\n", mountOpts))
+			if existed && string(old) == string(content) {
+				// nothing changed, nothing to (re)mount either
+				break
+			}
+			if err := os.MkdirAll(overrideDir, 0755); err != nil {
+				revertPending()
+				return err
+			}
+			if err := osutil.AtomicWriteFile(overridePath, content, 0644, 0); err != nil {
+				revertPending()
+				return err
+			}
+			pending = append(pending, revert{overridePath, existed, old})
+			remount = live
+		}
+
+		if !remount {
+			continue
+		}
+
+		mountArgs := append([]string{"remount"}, strings.Split(mountOpts, ",")...)
+		if err := tmpfsMounter.Mount("", m.mountPoint, "", mountArgs); err != nil {
+			revertPending()
+			return err
+		}
+		// this mount point's override.conf is now confirmed live
+		pending = nil
+	}
+
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -31,6 +32,7 @@ import (
 	"github.com/snapcore/snapd/dirs"
 	"github.com/snapcore/snapd/osutil"
 	"github.com/snapcore/snapd/overlord/configstate/configcore"
+	"github.com/snapcore/snapd/overlord/configstate/configcore/mounter"
 	"github.com/snapcore/snapd/testutil"
 )
 
@@ -222,3 +224,156 @@ func (s *tmpfsSuite) TestFilesystemOnlyApply(c *C) {
 	c.Check(tmpfsOverrCfg, testutil.FileEquals,
 		"[Mount]\nOptions=mode=1777,strictatime,nosuid,nodev,size=16384k\n")
 }
+
+// Configure the extra tmp.* knobs and check the composed Options= line
+func (s *tmpfsSuite) TestConfigureTmpfsExtraOptsGoodVals(c *C) {
+	mountCmd := testutil.MockCommand(c, "mount", "")
+	defer mountCmd.Restore()
+
+	err := configcore.Run(coreDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"tmp.mode":      "0755",
+			"tmp.noexec":    "true",
+			"tmp.nr-inodes": "2m",
+			"tmp.huge":      "within_size",
+			"tmp.uid":       "1000",
+			"tmp.gid":       "1001",
+		},
+	})
+	c.Assert(err, IsNil)
+
+	c.Check(s.servOverridePath, testutil.FileEquals,
+		"[Mount]\nOptions=mode=755,strictatime,nosuid,nodev,noexec,nr_inodes=2m,huge=within_size,uid=1000,gid=1001,size=50%\n")
+	c.Check(mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-o", "remount,mode=755,strictatime,nosuid,nodev,noexec,nr_inodes=2m,huge=within_size,uid=1000,gid=1001,size=50%", "/tmp"},
+	})
+}
+
+// Disabling one of the bool overrides must not affect the others
+func (s *tmpfsSuite) TestConfigureTmpfsBoolOverrides(c *C) {
+	mountCmd := testutil.MockCommand(c, "mount", "")
+	defer mountCmd.Restore()
+
+	err := configcore.Run(coreDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"tmp.nosuid": "false",
+		},
+	})
+	c.Assert(err, IsNil)
+
+	c.Check(s.servOverridePath, testutil.FileEquals,
+		"[Mount]\nOptions=mode=1777,strictatime,nodev,size=50%\n")
+}
+
+// Bad values for the extra tmp.* knobs are rejected before anything is written
+func (s *tmpfsSuite) TestConfigureTmpfsExtraOptsBadVals(c *C) {
+	for _, tc := range []struct {
+		conf map[string]interface{}
+		err  string
+	}{
+		{map[string]interface{}{"tmp.mode": "2000"}, `cannot set tmpfs mode.*`},
+		{map[string]interface{}{"tmp.mode": "abc"}, `cannot set tmpfs mode.*`},
+		{map[string]interface{}{"tmp.noexec": "nah"}, `cannot set tmpfs noexec.*`},
+		{map[string]interface{}{"tmp.nr-inodes": "2x"}, `cannot set tmpfs nr-inodes.*`},
+		{map[string]interface{}{"tmp.huge": "sometimes"}, `cannot set tmpfs huge.*`},
+		{map[string]interface{}{"tmp.uid": "nobody"}, `cannot set tmpfs uid.*`},
+		{map[string]interface{}{"tmp.gid": "-1"}, `cannot set tmpfs gid.*`},
+	} {
+		err := configcore.Run(coreDev, &mockConf{
+			state: s.state,
+			conf:  tc.conf,
+		})
+		c.Assert(err, ErrorMatches, tc.err)
+
+		_, err = os.Stat(s.servOverridePath)
+		c.Assert(os.IsNotExist(err), Equals, true)
+	}
+}
+
+// Configure shm.size, run.size and run-lock.size, each managing their
+// own override.conf independently from tmp.size
+func (s *tmpfsSuite) TestConfigureOtherTmpfsMounts(c *C) {
+	mountCmd := testutil.MockCommand(c, "mount", "")
+	defer mountCmd.Restore()
+
+	err := configcore.Run(coreDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"shm.size":      "200m",
+			"run.size":      "10%",
+			"run-lock.size": "16M",
+		},
+	})
+	c.Assert(err, IsNil)
+
+	shmOverride := filepath.Join(dirs.SnapServicesDir, "dev-shm.mount.d", "override.conf")
+	runOverride := filepath.Join(dirs.SnapServicesDir, "run.mount.d", "override.conf")
+	runLockOverride := filepath.Join(dirs.SnapServicesDir, "run-lock.mount.d", "override.conf")
+
+	c.Check(shmOverride, testutil.FileEquals,
+		"[Mount]\nOptions=mode=1777,strictatime,nosuid,nodev,size=200m\n")
+	c.Check(runOverride, testutil.FileEquals,
+		"[Mount]\nOptions=mode=0755,strictatime,nosuid,nodev,size=10%\n")
+	c.Check(runLockOverride, testutil.FileEquals,
+		"[Mount]\nOptions=mode=1777,strictatime,nosuid,nodev,size=16M\n")
+
+	// tmp.size was never touched
+	_, err = os.Stat(s.servOverridePath)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Check(mountCmd.Calls(), DeepEquals, [][]string{
+		{"mount", "-o", "remount,mode=1777,strictatime,nosuid,nodev,size=200m", "/dev/shm"},
+		{"mount", "-o", "remount,mode=0755,strictatime,nosuid,nodev,size=10%", "/run"},
+		{"mount", "-o", "remount,mode=1777,strictatime,nosuid,nodev,size=16M", "/run/lock"},
+	})
+}
+
+// Too-small sizes on the additional mounts are rejected with the same
+// rule as tmp.size
+func (s *tmpfsSuite) TestConfigureOtherTmpfsMountsTooSmall(c *C) {
+	err := configcore.Run(coreDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"shm.size": "1",
+		},
+	})
+	c.Assert(err, ErrorMatches, `size is less than 16Mb`)
+}
+
+// If the remount of a later mount point fails after an earlier mount
+// point's remount already succeeded, only the later mount point's
+// override.conf (which was never actually applied) is reverted: the
+// earlier one is left in place, since it matches what is actually live.
+func (s *tmpfsSuite) TestConfigureTmpfsAtomicAcrossMounts(c *C) {
+	fake := mounter.NewFake()
+	fake.FailMountAfter = 1 // the first Mount call succeeds, the rest fail
+	restore := configcore.MockMounter(fake)
+	defer restore()
+
+	err := configcore.Run(coreDev, &mockConf{
+		state: s.state,
+		conf: map[string]interface{}{
+			"tmp.size": "100m",
+			"shm.size": "200m",
+		},
+	})
+	c.Assert(err, ErrorMatches, "(?s).*fake mount failure.*")
+
+	// tmp's remount went through first and succeeded: its override.conf
+	// reflects the new, now-live configuration
+	c.Check(s.servOverridePath, testutil.FileEquals,
+		"[Mount]\nOptions=mode=1777,strictatime,nosuid,nodev,size=100m\n")
+
+	// shm's remount never succeeded: its override.conf was reverted, so
+	// it does not claim a configuration that was never actually applied
+	shmOverride := filepath.Join(dirs.SnapServicesDir, "dev-shm.mount.d", "override.conf")
+	_, err = os.Stat(shmOverride)
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	c.Check(fake.Actions, DeepEquals, []mounter.FakeAction{
+		{Action: "mount", Target: "/tmp", Options: strings.Split("remount,mode=1777,strictatime,nosuid,nodev,size=100m", ",")},
+		{Action: "mount", Target: "/dev/shm", Options: strings.Split("remount,mode=1777,strictatime,nosuid,nodev,size=200m", ",")},
+	})
+}